@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// udpBatchSize is how many datagrams a single ReadBatch/WriteBatch call
+// tries to move in one syscall (recvmmsg/sendmmsg on Linux).
+const udpBatchSize = 8
+
+// BatchPacketConn is implemented by net.PacketConns that can read or
+// write several datagrams per call. shadow() may return a conn that
+// implements this directly so encryption/decryption itself is batched;
+// conns that don't implement it are still driven through ReadBatch and
+// WriteBatch via the ipv4/ipv6 wrapper in asBatchPacketConn, decrypting
+// one message at a time.
+type BatchPacketConn interface {
+	net.PacketConn
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// packetBatch is a reusable set of message buffers, each preallocated to
+// udpBufSize, so a batch read/write doesn't allocate on the hot path.
+type packetBatch struct {
+	Messages []ipv4.Message
+}
+
+var packetBatchPool = sync.Pool{
+	New: func() any {
+		b := &packetBatch{Messages: make([]ipv4.Message, udpBatchSize)}
+		for i := range b.Messages {
+			b.Messages[i].Buffers = [][]byte{make([]byte, udpBufSize)}
+		}
+		return b
+	},
+}
+
+func getPacketBatch() *packetBatch { return packetBatchPool.Get().(*packetBatch) }
+func putPacketBatch(b *packetBatch) { packetBatchPool.Put(b) }
+
+// asBatchPacketConn adapts pc to BatchPacketConn. If pc already
+// implements it (e.g. a cipher that batches decryption), that
+// implementation is used directly. Otherwise pc is wrapped in the
+// matching golang.org/x/net/ipv4 or ipv6 PacketConn, whose
+// ReadBatch/WriteBatch use recvmmsg/sendmmsg on Linux and fall back to
+// one syscall per message on platforms that don't support batching.
+func asBatchPacketConn(pc net.PacketConn) BatchPacketConn {
+	if bc, ok := pc.(BatchPacketConn); ok {
+		return bc
+	}
+	if isIPv6(pc) {
+		return ipv6BatchConn{pc: pc, bc: ipv6.NewPacketConn(pc)}
+	}
+	return ipv4BatchConn{pc: pc, bc: ipv4.NewPacketConn(pc)}
+}
+
+func isIPv6(pc net.PacketConn) bool {
+	a, ok := pc.LocalAddr().(*net.UDPAddr)
+	return ok && a.IP.To4() == nil
+}
+
+// ipv4BatchConn and ipv6BatchConn pair a plain net.PacketConn with the
+// x/net wrapper that gives it ReadBatch/WriteBatch, so together they
+// satisfy BatchPacketConn.
+type ipv4BatchConn struct {
+	pc net.PacketConn
+	bc *ipv4.PacketConn
+}
+
+func (c ipv4BatchConn) ReadFrom(b []byte) (int, net.Addr, error) { return c.pc.ReadFrom(b) }
+func (c ipv4BatchConn) WriteTo(b []byte, addr net.Addr) (int, error) { return c.pc.WriteTo(b, addr) }
+func (c ipv4BatchConn) Close() error { return c.pc.Close() }
+func (c ipv4BatchConn) LocalAddr() net.Addr { return c.pc.LocalAddr() }
+func (c ipv4BatchConn) SetDeadline(t time.Time) error { return c.pc.SetDeadline(t) }
+func (c ipv4BatchConn) SetReadDeadline(t time.Time) error { return c.pc.SetReadDeadline(t) }
+func (c ipv4BatchConn) SetWriteDeadline(t time.Time) error { return c.pc.SetWriteDeadline(t) }
+func (c ipv4BatchConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	return c.bc.ReadBatch(ms, flags)
+}
+func (c ipv4BatchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	return c.bc.WriteBatch(ms, flags)
+}
+
+type ipv6BatchConn struct {
+	pc net.PacketConn
+	bc *ipv6.PacketConn
+}
+
+func (c ipv6BatchConn) ReadFrom(b []byte) (int, net.Addr, error) { return c.pc.ReadFrom(b) }
+func (c ipv6BatchConn) WriteTo(b []byte, addr net.Addr) (int, error) { return c.pc.WriteTo(b, addr) }
+func (c ipv6BatchConn) Close() error { return c.pc.Close() }
+func (c ipv6BatchConn) LocalAddr() net.Addr { return c.pc.LocalAddr() }
+func (c ipv6BatchConn) SetDeadline(t time.Time) error { return c.pc.SetDeadline(t) }
+func (c ipv6BatchConn) SetReadDeadline(t time.Time) error { return c.pc.SetReadDeadline(t) }
+func (c ipv6BatchConn) SetWriteDeadline(t time.Time) error { return c.pc.SetWriteDeadline(t) }
+func (c ipv6BatchConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	return c.bc.ReadBatch(ms, flags)
+}
+func (c ipv6BatchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	return c.bc.WriteBatch(ms, flags)
+}
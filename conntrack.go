@@ -0,0 +1,258 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Metrics lets operators observe conntrack activity (flow lifecycle and
+// byte counts) without this package importing any particular metrics
+// backend. Wire up a Prometheus-backed implementation (or any other)
+// and hand it to ConntrackConfig; nothing here depends on it.
+type Metrics interface {
+	FlowOpened()
+	FlowClosed()
+	FlowEvicted()
+	FlowTimedOut()
+	BytesIn(n int)
+	BytesOut(n int)
+}
+
+// noopMetrics is the default Metrics implementation; it discards every event.
+type noopMetrics struct{}
+
+func (noopMetrics) FlowOpened()   {}
+func (noopMetrics) FlowClosed()   {}
+func (noopMetrics) FlowEvicted()  {}
+func (noopMetrics) FlowTimedOut() {}
+func (noopMetrics) BytesIn(int)   {}
+func (noopMetrics) BytesOut(int)  {}
+
+// udpMetrics is consulted by every conntrack table created in this
+// package. Operators can replace it (e.g. from main, before the first
+// udpLocal/udpSocksLocal/udpRemote call) to export metrics without this
+// module importing a metrics library itself.
+var udpMetrics Metrics = noopMetrics{}
+
+// connTrackKey identifies a flow by both the client and the target it
+// talks to, so a client fanning out to several targets gets a distinct
+// tracked flow (and upstream socket) per target instead of multiplexing
+// them all over one.
+type connTrackKey struct {
+	client netip.AddrPort
+	target netip.AddrPort
+}
+
+// connTrackEntry is one tracked flow.
+type connTrackEntry struct {
+	key        connTrackKey
+	dst        net.PacketConn
+	src        net.PacketConn
+	elem       *list.Element // in conntrack.lru
+	clientElem *list.Element // in conntrack.byClient[key.client.Addr()]
+}
+
+// ConntrackConfig configures a conntrack table.
+type ConntrackConfig struct {
+	// Timeout is the read deadline applied to a flow's upstream socket;
+	// the flow is torn down once it elapses without a reply.
+	Timeout time.Duration
+	// MaxEntries caps the total number of tracked flows. 0 means
+	// unlimited, which is what every call site in this package uses
+	// today; set it from a flag if operators need the cap enforced.
+	MaxEntries int
+	// MaxPerClient caps the number of flows a single client address may
+	// hold open at once, evicting that client's own oldest flow to make
+	// room rather than some other client's. 0 means unlimited, which is
+	// what every call site in this package uses today.
+	MaxPerClient int
+	// Metrics receives flow lifecycle and traffic events. Defaults to
+	// udpMetrics when nil.
+	Metrics Metrics
+}
+
+// conntrack is an authoritative connection-tracking NAT table for UDP
+// flows, keyed on (client, target) rather than the client alone, with
+// bounded size, LRU eviction, and an explicit Close that waits for every
+// flow's copy goroutine to exit. It replaces the old timeout-only natmap.
+type conntrack struct {
+	cfg ConntrackConfig
+
+	mu       sync.Mutex
+	entries  map[connTrackKey]*connTrackEntry
+	byClient map[netip.Addr]*list.List // per client, front = least recently used
+	lru      *list.List                // global, front = least recently used
+	closed   bool
+
+	wg sync.WaitGroup
+}
+
+func newConntrack(cfg ConntrackConfig) *conntrack {
+	if cfg.Metrics == nil {
+		cfg.Metrics = udpMetrics
+	}
+	return &conntrack{
+		cfg:      cfg,
+		entries:  make(map[connTrackKey]*connTrackEntry),
+		byClient: make(map[netip.Addr]*list.List),
+		lru:      list.New(),
+	}
+}
+
+// Get returns the conn tracked for (client, target), or nil if there isn't one.
+func (t *conntrack) Get(client, target netip.AddrPort) net.PacketConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[connTrackKey{client, target}]
+	if !ok {
+		return nil
+	}
+	t.lru.MoveToBack(e.elem)
+	if cl, ok := t.byClient[client.Addr()]; ok {
+		cl.MoveToBack(e.clientElem)
+	}
+	return e.src
+}
+
+// Add tracks a new flow from client to target, relaying src<->dst, and
+// starts the goroutine that copies replies back until the flow times
+// out, is evicted to make room, or the table is closed. onClose, if not
+// nil, is called once the flow ends on its own (not when it's cut short
+// by eviction or Close, since neither says anything about the upstream
+// server). gotReply reports whether src ever returned a usable datagram
+// before the flow ended, and timedOut reports whether it ended by
+// hitting the read deadline; callers use gotReply to tell an ordinary
+// idle timeout after a successful flow apart from a server that never
+// replied at all (see the endpoints package).
+func (t *conntrack) Add(client, target netip.AddrPort, dst, src net.PacketConn, role mode, onClose func(gotReply, timedOut bool)) {
+	key := connTrackKey{client, target}
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		src.Close()
+		return
+	}
+	if t.cfg.MaxPerClient > 0 {
+		if cl := t.byClient[client.Addr()]; cl != nil && cl.Len() >= t.cfg.MaxPerClient {
+			t.evictClientLocked(cl)
+		}
+	}
+	if t.cfg.MaxEntries > 0 && len(t.entries) >= t.cfg.MaxEntries {
+		t.evictLocked()
+	}
+	e := &connTrackEntry{key: key, dst: dst, src: src}
+	e.elem = t.lru.PushBack(e)
+	cl, ok := t.byClient[client.Addr()]
+	if !ok {
+		cl = list.New()
+		t.byClient[client.Addr()] = cl
+	}
+	e.clientElem = cl.PushBack(e)
+	t.entries[key] = e
+	t.mu.Unlock()
+
+	t.cfg.Metrics.FlowOpened()
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		gotReply, err := timedCopy(dst, client, src, t.cfg.Timeout, role, t.cfg.Metrics)
+		var ne net.Error
+		timedOut := errors.As(err, &ne) && ne.Timeout()
+		natural := t.remove(e, timedOut)
+		if onClose != nil && natural {
+			onClose(gotReply, timedOut)
+		}
+	}()
+}
+
+// evictLocked drops the global least recently used flow, across every
+// client, to make room for a new one under MaxEntries. Callers must hold
+// t.mu.
+func (t *conntrack) evictLocked() {
+	front := t.lru.Front()
+	if front == nil {
+		return
+	}
+	e := front.Value.(*connTrackEntry)
+	t.deleteLocked(e)
+	t.cfg.Metrics.FlowEvicted()
+	e.src.Close()
+}
+
+// evictClientLocked drops cl's own least recently used flow to make room
+// for a new one under MaxPerClient, so a client bumping into its own cap
+// only ever costs it one of its own flows, never another client's.
+// Callers must hold t.mu.
+func (t *conntrack) evictClientLocked(cl *list.List) {
+	front := cl.Front()
+	if front == nil {
+		return
+	}
+	e := front.Value.(*connTrackEntry)
+	t.deleteLocked(e)
+	t.cfg.Metrics.FlowEvicted()
+	e.src.Close()
+}
+
+// remove drops e from the table if it is still the tracked entry for its
+// key and closes its upstream conn, returning true. If e was already
+// evicted or dropped by Close, remove does nothing and returns false, so
+// the caller can tell its own natural end apart from being cut short.
+func (t *conntrack) remove(e *connTrackEntry, timedOut bool) bool {
+	t.mu.Lock()
+	cur, tracked := t.entries[e.key]
+	if tracked && cur == e {
+		t.deleteLocked(e)
+	}
+	t.mu.Unlock()
+
+	if !tracked || cur != e {
+		return false
+	}
+	if timedOut {
+		t.cfg.Metrics.FlowTimedOut()
+	}
+	t.cfg.Metrics.FlowClosed()
+	e.src.Close()
+	return true
+}
+
+// deleteLocked removes e from the entries map, the global LRU list, and
+// its client's LRU list. Callers must hold t.mu.
+func (t *conntrack) deleteLocked(e *connTrackEntry) {
+	delete(t.entries, e.key)
+	t.lru.Remove(e.elem)
+	client := e.key.client.Addr()
+	if cl, ok := t.byClient[client]; ok {
+		cl.Remove(e.clientElem)
+		if cl.Len() == 0 {
+			delete(t.byClient, client)
+		}
+	}
+}
+
+// Close tears down every tracked flow and waits for their copy
+// goroutines to exit before returning.
+func (t *conntrack) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	entries := make([]*connTrackEntry, 0, len(t.entries))
+	for _, e := range t.entries {
+		entries = append(entries, e)
+	}
+	t.entries = make(map[connTrackKey]*connTrackEntry)
+	t.byClient = make(map[netip.Addr]*list.List)
+	t.lru.Init()
+	t.mu.Unlock()
+
+	for _, e := range entries {
+		e.src.Close()
+	}
+	t.wg.Wait()
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func mustListenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	return c
+}
+
+func udpAddrPort(c *net.UDPConn) netip.AddrPort {
+	return c.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// TestConntrackMaxPerClientEvictsOwnEntry guards against MaxPerClient
+// evicting the table-wide LRU front (some other, well-behaved client's
+// flow) instead of the offending client's own oldest flow.
+func TestConntrackMaxPerClientEvictsOwnEntry(t *testing.T) {
+	ct := newConntrack(ConntrackConfig{Timeout: time.Minute, MaxPerClient: 2})
+	defer ct.Close()
+
+	busy := netip.MustParseAddrPort("10.0.0.1:1234")
+	quiet := netip.MustParseAddrPort("10.0.0.2:1234")
+	quietTarget := netip.MustParseAddrPort("2.2.2.2:53")
+
+	quietDst, quietSrc := mustListenUDP(t), mustListenUDP(t)
+	defer quietDst.Close()
+	ct.Add(quiet, quietTarget, quietDst, quietSrc, relayClient, nil)
+
+	targets := []netip.AddrPort{
+		netip.MustParseAddrPort("1.1.1.1:53"),
+		netip.MustParseAddrPort("1.1.1.2:53"),
+		netip.MustParseAddrPort("1.1.1.3:53"),
+	}
+	for _, tgt := range targets {
+		dst, src := mustListenUDP(t), mustListenUDP(t)
+		defer dst.Close()
+		ct.Add(busy, tgt, dst, src, relayClient, nil)
+	}
+
+	if got := ct.Get(busy, targets[0]); got != nil {
+		t.Errorf("busy's oldest flow should have been evicted to stay under MaxPerClient")
+	}
+	if got := ct.Get(busy, targets[2]); got == nil {
+		t.Errorf("busy's newest flow should still be tracked")
+	}
+	if got := ct.Get(quiet, quietTarget); got == nil {
+		t.Errorf("quiet's flow should not be evicted by busy exceeding its own cap")
+	}
+}
+
+// TestConntrackCloseDrainsFlows checks that Close tears down every
+// tracked flow's upstream conn and waits for its copy goroutine before
+// returning.
+func TestConntrackCloseDrainsFlows(t *testing.T) {
+	ct := newConntrack(ConntrackConfig{Timeout: time.Minute})
+
+	dst, src := mustListenUDP(t), mustListenUDP(t)
+	defer dst.Close()
+	ct.Add(netip.MustParseAddrPort("10.0.0.1:1"), netip.MustParseAddrPort("3.3.3.3:53"), dst, src, relayClient, nil)
+
+	if err := ct.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := src.WriteToUDPAddrPort([]byte("x"), udpAddrPort(dst)); err == nil {
+		t.Errorf("expected src to be closed once Close returns")
+	}
+}
+
+// TestConntrackRelaysReplyToClientNotTarget exercises a flow end-to-end:
+// a reply arriving on src must be written out dst addressed at the
+// client, never at target. (timedCopy once addressed relayed packets at
+// target instead of client, so every reply went to the wrong place.)
+func TestConntrackRelaysReplyToClientNotTarget(t *testing.T) {
+	clientSock := mustListenUDP(t)
+	defer clientSock.Close()
+	targetSock := mustListenUDP(t) // stands in for the NAT key's target; never actually talked to
+	defer targetSock.Close()
+
+	dstSock := mustListenUDP(t) // the relay's client-facing socket (like c or pc)
+	defer dstSock.Close()
+	srcSock := mustListenUDP(t) // the relay's per-flow upstream socket, owned by conntrack
+
+	client := udpAddrPort(clientSock)
+	target := udpAddrPort(targetSock)
+
+	ct := newConntrack(ConntrackConfig{Timeout: 5 * time.Second})
+	defer ct.Close()
+	ct.Add(client, target, dstSock, srcSock, relayClient, nil)
+
+	// Simulate the upstream shadowsocks server replying on srcSock with a
+	// SOCKS-addressed payload, the way udpLocal's serverConn would.
+	tgtAddr := socks.ParseAddr(target.String())
+	payload := []byte("hello client")
+	reply := append(append([]byte{}, tgtAddr...), payload...)
+
+	sender, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer sender.Close()
+	if _, err := sender.WriteToUDPAddrPort(reply, udpAddrPort(srcSock)); err != nil {
+		t.Fatalf("write reply: %v", err)
+	}
+
+	clientSock.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 256)
+	n, _, err := clientSock.ReadFromUDPAddrPort(buf)
+	if err != nil {
+		t.Fatalf("client never received the relayed reply: %v", err)
+	}
+	if got := string(buf[:n]); got != string(payload) {
+		t.Errorf("client got %q, want %q", got, payload)
+	}
+
+	targetSock.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := targetSock.ReadFromUDP(make([]byte, 16)); err == nil {
+		t.Errorf("reply should never be sent to target, only to client")
+	}
+}
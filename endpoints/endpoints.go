@@ -0,0 +1,139 @@
+// Package endpoints tracks a set of upstream shadowsocks servers and
+// picks one for each new flow, sharing health state between the UDP NAT
+// path and a TCP dialer so both protocols route around the same failures.
+package endpoints
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// Strategy selects an upstream endpoint for a new flow.
+type Strategy int
+
+const (
+	// RoundRobin cycles through healthy endpoints in turn, once per new
+	// NAT entry (or dial).
+	RoundRobin Strategy = iota
+	// ClientHash picks an endpoint by hashing the client address, so a
+	// given client keeps landing on the same endpoint while it stays
+	// healthy.
+	ClientHash
+)
+
+// MaxConsecutiveFailures is the number of consecutive read timeouts an
+// endpoint's bound socket can rack up before it is marked unhealthy.
+const MaxConsecutiveFailures = 3
+
+// endpoint tracks the health of a single upstream server address.
+type endpoint struct {
+	addr      string
+	failures  atomic.Int32
+	unhealthy atomic.Bool
+}
+
+// Endpoints is a shared, thread-safe set of upstream servers with
+// pluggable selection and failure tracking. A single instance can back
+// both the UDP NAT path and a TCP dialer so health state is consistent
+// across protocols.
+type Endpoints struct {
+	list     []*endpoint
+	strategy Strategy
+
+	mu   sync.Mutex
+	next uint32
+}
+
+// New builds an Endpoints set from a list of "host:port" server
+// addresses, selected according to strategy. addrs must be non-empty.
+func New(addrs []string, strategy Strategy) *Endpoints {
+	e := &Endpoints{strategy: strategy}
+	for _, a := range addrs {
+		e.list = append(e.list, &endpoint{addr: a})
+	}
+	return e
+}
+
+// Pick returns the server address to use for a new flow from client,
+// preferring endpoints that aren't currently marked unhealthy. If every
+// endpoint is unhealthy it still returns one (chosen the same way as a
+// healthy pick would be), since a recovered server is only discovered by
+// trying it again.
+func (e *Endpoints) Pick(client netip.AddrPort) string {
+	n := len(e.list)
+	if n == 0 {
+		return ""
+	}
+
+	start := e.start(client, n)
+	for i := 0; i < n; i++ {
+		ep := e.list[(start+i)%n]
+		if !ep.unhealthy.Load() {
+			return ep.addr
+		}
+	}
+	return e.list[start].addr
+}
+
+func (e *Endpoints) start(client netip.AddrPort, n int) int {
+	if e.strategy == ClientHash {
+		return int(hashAddrPort(client) % uint64(n))
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	i := e.next % uint32(n)
+	e.next++
+	return int(i)
+}
+
+// ReportTimeout records that addr's NAT-bound socket hit its read
+// deadline without ever receiving a single reply, marking it unhealthy
+// once MaxConsecutiveFailures have happened in a row without an
+// intervening ReportSuccess. Callers must not call this for a flow that
+// received at least one reply before idling out — that's ordinary
+// traffic, not a server failure, and belongs in ReportSuccess instead.
+func (e *Endpoints) ReportTimeout(addr string) {
+	ep := e.find(addr)
+	if ep == nil {
+		return
+	}
+	if ep.failures.Add(1) >= MaxConsecutiveFailures {
+		ep.unhealthy.Store(true)
+	}
+}
+
+// ReportSuccess clears addr's failure count and health flag, e.g. after
+// a flow using it receives at least one reply, even if it later idles
+// out.
+func (e *Endpoints) ReportSuccess(addr string) {
+	ep := e.find(addr)
+	if ep == nil {
+		return
+	}
+	ep.failures.Store(0)
+	ep.unhealthy.Store(false)
+}
+
+func (e *Endpoints) find(addr string) *endpoint {
+	for _, ep := range e.list {
+		if ep.addr == addr {
+			return ep
+		}
+	}
+	return nil
+}
+
+// hashAddrPort is a small FNV-1a hash over the client address and port,
+// used for ClientHash stickiness.
+func hashAddrPort(a netip.AddrPort) uint64 {
+	const offset, prime = 14695981039346656037, 1099511628211
+	h := uint64(offset)
+	for _, b := range a.Addr().As16() {
+		h ^= uint64(b)
+		h *= prime
+	}
+	h ^= uint64(a.Port())
+	h *= prime
+	return h
+}
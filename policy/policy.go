@@ -0,0 +1,207 @@
+// Package policy restricts which targets a client may reach and how
+// much traffic each client may send. It is structured as its own
+// package, independent of the UDP or TCP transport, so a server can
+// apply the same rules to both.
+package policy
+
+import (
+	"container/list"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// maxTrackedClients bounds IPFilter's rate-limit state. UDP source
+// addresses are trivially spoofable, so without a cap a flood of forged
+// sources would grow the bucket map without limit.
+const maxTrackedClients = 4096
+
+// TargetPolicy is consulted before a server forwards a client's packet
+// to a target. Callers should check AllowTarget again once a target
+// domain name has been resolved to an IP, so a target that resolves to
+// a forbidden range (DNS rebinding) is still rejected.
+type TargetPolicy interface {
+	// AllowTarget reports whether client may reach target, returning a
+	// descriptive error if not.
+	AllowTarget(client, target netip.AddrPort) error
+	// Allow reports whether client may send an n-byte packet right now,
+	// accounting it against the client's rate limits.
+	Allow(client netip.AddrPort, n int) error
+}
+
+// IPFilter is the default TargetPolicy. It rejects loopback, link-local,
+// multicast, and RFC1918 destinations by default, and enforces
+// per-client packet-per-second and byte-per-second limits with a token
+// bucket per client address, LRU-evicting buckets past maxTrackedClients
+// since client addresses arrive over UDP and are trivially spoofable.
+type IPFilter struct {
+	// DenyLoopback, DenyLinkLocal, DenyMulticast, and DenyPrivate gate
+	// the corresponding destination address classes. NewIPFilter sets
+	// all four to true.
+	DenyLoopback  bool
+	DenyLinkLocal bool
+	DenyMulticast bool
+	DenyPrivate   bool
+
+	// PacketsPerSecond and BytesPerSecond cap each client's throughput.
+	// 0 means unlimited.
+	PacketsPerSecond float64
+	BytesPerSecond   float64
+
+	mu      sync.Mutex
+	buckets map[netip.Addr]*list.Element // value is *clientBucket
+	lru     *list.List                   // front = least recently used
+}
+
+// clientBucket pairs a client address with its token bucket, so an
+// evicted *list.Element's Value still names the map key to delete.
+type clientBucket struct {
+	addr   netip.Addr
+	bucket *tokenBucket
+}
+
+// NewIPFilter returns an IPFilter with every built-in address class
+// denied and the given per-client rate limits (0 means unlimited).
+func NewIPFilter(packetsPerSecond, bytesPerSecond float64) *IPFilter {
+	return &IPFilter{
+		DenyLoopback:     true,
+		DenyLinkLocal:    true,
+		DenyMulticast:    true,
+		DenyPrivate:      true,
+		PacketsPerSecond: packetsPerSecond,
+		BytesPerSecond:   bytesPerSecond,
+		buckets:          make(map[netip.Addr]*list.Element),
+		lru:              list.New(),
+	}
+}
+
+// AllowTarget implements TargetPolicy.
+func (f *IPFilter) AllowTarget(client, target netip.AddrPort) error {
+	a := target.Addr()
+	switch {
+	case f.DenyLoopback && a.IsLoopback():
+		return fmt.Errorf("target %s is a loopback address", a)
+	case f.DenyLinkLocal && (a.IsLinkLocalUnicast() || a.IsLinkLocalMulticast()):
+		return fmt.Errorf("target %s is a link-local address", a)
+	case f.DenyMulticast && a.IsMulticast():
+		return fmt.Errorf("target %s is a multicast address", a)
+	case f.DenyPrivate && isPrivateRFC1918(a):
+		return fmt.Errorf("target %s is a private (RFC1918) address", a)
+	}
+	return nil
+}
+
+// isPrivateRFC1918 reports whether a is within 10/8, 172.16/12, or
+// 192.168/16. IPv4-mapped IPv6 addresses (::ffff:a.b.c.d) are unwrapped
+// first; every other IPv6 address, NAT64 (64:ff9b::/96) included, is
+// never considered private here.
+func isPrivateRFC1918(a netip.Addr) bool {
+	if a.Is4In6() {
+		a = a.Unmap()
+	}
+	if !a.Is4() {
+		return false
+	}
+	b := a.As4()
+	switch {
+	case b[0] == 10:
+		return true
+	case b[0] == 172 && b[1] >= 16 && b[1] <= 31:
+		return true
+	case b[0] == 192 && b[1] == 168:
+		return true
+	}
+	return false
+}
+
+// Allow implements TargetPolicy.
+func (f *IPFilter) Allow(client netip.AddrPort, n int) error {
+	if f.PacketsPerSecond <= 0 && f.BytesPerSecond <= 0 {
+		return nil
+	}
+
+	addr := client.Addr()
+	f.mu.Lock()
+	elem, ok := f.buckets[addr]
+	if ok {
+		f.lru.MoveToBack(elem)
+	} else {
+		if f.lru.Len() >= maxTrackedClients {
+			f.evictLocked()
+		}
+		cb := &clientBucket{addr: addr, bucket: newTokenBucket(f.PacketsPerSecond, f.BytesPerSecond)}
+		elem = f.lru.PushBack(cb)
+		f.buckets[addr] = elem
+	}
+	b := elem.Value.(*clientBucket).bucket
+	f.mu.Unlock()
+
+	return b.take(n)
+}
+
+// evictLocked drops the least recently seen client's bucket to make room
+// for a new one. Callers must hold f.mu.
+func (f *IPFilter) evictLocked() {
+	front := f.lru.Front()
+	if front == nil {
+		return
+	}
+	cb := front.Value.(*clientBucket)
+	f.lru.Remove(front)
+	delete(f.buckets, cb.addr)
+}
+
+// tokenBucket enforces independent packet-rate and byte-rate limits for
+// one client, refilling continuously based on elapsed wall time.
+type tokenBucket struct {
+	mu sync.Mutex
+
+	packetRate float64
+	packets    float64
+	byteRate   float64
+	bytes      float64
+	last       time.Time
+}
+
+func newTokenBucket(packetRate, byteRate float64) *tokenBucket {
+	return &tokenBucket{
+		packetRate: packetRate,
+		packets:    packetRate,
+		byteRate:   byteRate,
+		bytes:      byteRate,
+		last:       time.Now(),
+	}
+}
+
+func (b *tokenBucket) take(n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+
+	if b.packetRate > 0 {
+		b.packets = minFloat(b.packetRate, b.packets+elapsed*b.packetRate)
+		if b.packets < 1 {
+			return fmt.Errorf("packet rate limit exceeded")
+		}
+		b.packets--
+	}
+	if b.byteRate > 0 {
+		b.bytes = minFloat(b.byteRate, b.bytes+elapsed*b.byteRate)
+		if b.bytes < float64(n) {
+			return fmt.Errorf("byte rate limit exceeded")
+		}
+		b.bytes -= float64(n)
+	}
+	return nil
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
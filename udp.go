@@ -4,12 +4,32 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
-	"sync"
 	"time"
 
+	"golang.org/x/net/ipv4"
+
+	"github.com/shadowsocks/go-shadowsocks2/endpoints"
+	"github.com/shadowsocks/go-shadowsocks2/policy"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
+// targetPolicy is consulted by udpRemote for every packet. Operators can
+// replace it (e.g. from main, before the first udpRemote call) to
+// change the denied address classes or rate limits, or to swap in an
+// entirely different policy.TargetPolicy.
+var targetPolicy policy.TargetPolicy = policy.NewIPFilter(0, 0)
+
+// checkTargetPolicy enforces targetPolicy for one packet of payloadLen
+// bytes from client bound for target, shared by every remote-side
+// transport (plain UDP and UDP-over-TCP) so a policy change protects all
+// of them the same way instead of being wired into just one.
+func checkTargetPolicy(client, target netip.AddrPort, payloadLen int) error {
+	if err := targetPolicy.Allow(client, payloadLen); err != nil {
+		return err
+	}
+	return targetPolicy.AllowTarget(client, target)
+}
+
 type mode int
 
 const (
@@ -20,17 +40,43 @@ const (
 
 const udpBufSize = 64 * 1024
 
-// Listen on laddr for UDP packets, encrypt and send to server to reach target.
-func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.PacketConn) {
-	srvAddr, err := net.ResolveUDPAddr("udp", server)
-	if err != nil {
-		logf("UDP server address error: %v", err)
+// UDPConn is implemented by net.PacketConns that can read and write
+// netip.AddrPort directly, avoiding the net.Addr/string round trip.
+// *net.UDPConn satisfies this, and shadow() may return a wrapper that
+// forwards to the underlying *net.UDPConn.
+type UDPConn interface {
+	net.PacketConn
+	ReadFromUDPAddrPort([]byte) (int, netip.AddrPort, error)
+	WriteToUDPAddrPort([]byte, netip.AddrPort) (int, error)
+}
+
+// serverConn pairs an upstream-facing PacketConn with the server address
+// it was bound to at flow creation, so a flow keeps talking to the same
+// server for the lifetime of its NAT entry even though new flows may be
+// routed to a different one.
+type serverConn struct {
+	net.PacketConn
+	server string
+	addr   netip.AddrPort
+}
+
+// Listen on laddr for UDP packets, encrypt and send to a server (picked
+// per new NAT entry from servers via strategy) to reach target.
+func udpLocal(laddr string, servers []string, strategy endpoints.Strategy, target string, shadow func(net.PacketConn) net.PacketConn) {
+	if len(servers) == 0 {
+		logf("UDP server address error: no servers configured")
 		return
 	}
+	eps := endpoints.New(servers, strategy)
 
 	tgt := socks.ParseAddr(target)
 	if tgt == nil {
-		err = fmt.Errorf("invalid target address: %q", target)
+		err := fmt.Errorf("invalid target address: %q", target)
+		logf("UDP target address error: %v", err)
+		return
+	}
+	tgtAddrPort, err := socksAddrToNetip(tgt)
+	if err != nil {
 		logf("UDP target address error: %v", err)
 		return
 	}
@@ -48,50 +94,57 @@ func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.Pack
 	}
 	defer c.Close()
 
-	nm := newNATmap(config.UDPTimeout)
-	buf := make([]byte, udpBufSize)
-	copy(buf, tgt)
+	ct := newConntrack(ConntrackConfig{Timeout: config.UDPTimeout})
+	defer ct.Close()
+
+	sendBuf := make([]byte, udpBufSize)
+	copy(sendBuf, tgt)
 
-	logf("UDP tunnel %s <-> %s <-> %s", laddr, server, target)
+	bpc := asBatchPacketConn(c)
+
+	logf("UDP tunnel %s <-> %v <-> %s", laddr, servers, target)
 	for {
-		n, addr, err := c.ReadFrom(buf[len(tgt):])
+		b := getPacketBatch()
+		n, err := bpc.ReadBatch(b.Messages, 0)
 		if err != nil {
+			putPacketBatch(b)
 			logf("UDP local read error: %v", err)
 			continue
 		}
-		raddr, err := udpAddrToNetip(addr)
-		if err != nil {
-			logf("Address conversion failed: %v", err)
-			continue
-		}
 
-		pc := nm.Get(raddr)
-		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+		for i := 0; i < n; i++ {
+			msg := &b.Messages[i]
+			raddr, err := udpAddrToNetip(msg.Addr)
 			if err != nil {
-				logf("UDP local listen error: %v", err)
+				logf("Address conversion failed: %v", err)
 				continue
 			}
 
-			pc = shadow(pc)
-			nm.Add(raddr, c, pc, relayClient)
-		}
+			sc, err := getOrDialServerConn(ct, eps, c, raddr, tgtAddrPort, relayClient, shadow)
+			if err != nil {
+				logf("UDP local dial error: %v", err)
+				continue
+			}
 
-		_, err = pc.WriteTo(buf[:len(tgt)+n], srvAddr)
-		if err != nil {
-			logf("UDP local write error: %v", err)
-			continue
+			copy(sendBuf[len(tgt):], msg.Buffers[0][:msg.N])
+			_, err = writeToUDPAddrPort(sc, sendBuf[:len(tgt)+msg.N], sc.addr)
+			if err != nil {
+				logf("UDP local write error: %v", err)
+				continue
+			}
 		}
+		putPacketBatch(b)
 	}
 }
 
-// Listen on laddr for Socks5 UDP packets, encrypt and send to server to reach target.
-func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketConn) {
-	srvAddr, err := net.ResolveUDPAddr("udp", server)
-	if err != nil {
-		logf("UDP server address error: %v", err)
+// Listen on laddr for Socks5 UDP packets, encrypt and send to a server
+// (picked per new NAT entry from servers via strategy) to reach target.
+func udpSocksLocal(laddr string, servers []string, strategy endpoints.Strategy, shadow func(net.PacketConn) net.PacketConn) {
+	if len(servers) == 0 {
+		logf("UDP server address error: no servers configured")
 		return
 	}
+	eps := endpoints.New(servers, strategy)
 
 	lnAddr, err := net.ResolveUDPAddr("udp", laddr)
 	if err != nil {
@@ -106,47 +159,56 @@ func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketC
 	}
 	defer c.Close()
 
-	nm := newNATmap(config.UDPTimeout)
-	buf := make([]byte, udpBufSize)
+	ct := newConntrack(ConntrackConfig{Timeout: config.UDPTimeout})
+	defer ct.Close()
+
+	bpc := asBatchPacketConn(c)
 
 	for {
-		n, addr, err := c.ReadFrom(buf)
+		b := getPacketBatch()
+		n, err := bpc.ReadBatch(b.Messages, 0)
 		if err != nil {
+			putPacketBatch(b)
 			logf("UDP local read error: %v", err)
 			continue
 		}
-		raddr, err := udpAddrToNetip(addr)
-		if err != nil {
-			logf("Address conversion failed: %v", err)
-			continue
-		}
 
-		pc := nm.Get(raddr)
-		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+		for i := 0; i < n; i++ {
+			msg := &b.Messages[i]
+			raddr, err := udpAddrToNetip(msg.Addr)
 			if err != nil {
-				logf("UDP local listen error: %v", err)
+				logf("Address conversion failed: %v", err)
 				continue
 			}
-			logf("UDP socks tunnel %s <-> %s <-> %s", laddr, server, socks.Addr(buf[3:]))
-			pc = shadow(pc)
-			nm.Add(raddr, c, pc, socksClient)
-		}
+			buf := msg.Buffers[0][:msg.N]
 
-		_, err = pc.WriteTo(buf[3:n], srvAddr)
-		if err != nil {
-			logf("UDP local write error: %v", err)
-			continue
+			tgtAddr := socks.SplitAddr(buf[3:])
+			if tgtAddr == nil {
+				logf("failed to split target address from packet: %q", buf[3:])
+				continue
+			}
+			tgtAddrPort, err := socksAddrToNetip(tgtAddr)
+			if err != nil {
+				logf("failed to resolve target UDP address: %v", err)
+				continue
+			}
+
+			sc, err := getOrDialServerConn(ct, eps, c, raddr, tgtAddrPort, socksClient, shadow)
+			if err != nil {
+				logf("UDP local dial error: %v", err)
+				continue
+			}
+
+			_, err = writeToUDPAddrPort(sc, buf[3:], sc.addr)
+			if err != nil {
+				logf("UDP local write error: %v", err)
+				continue
+			}
 		}
+		putPacketBatch(b)
 	}
 }
 
-type UDPConn interface {
-	net.PacketConn
-	ReadFromUDPAddrPort([]byte) (int, netip.AddrPort, error)
-	WriteToUDPAddrPort([]byte, netip.AddrPort) (int, error)
-}
-
 // Listen on addr for encrypted packets and basically do UDP NAT.
 func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
 	nAddr, err := net.ResolveUDPAddr("udp", addr)
@@ -161,151 +223,227 @@ func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
 	}
 	defer cc.Close()
 	pc := shadow(cc) // net.PacketConn
-	nm := newNATmap(config.UDPTimeout)
-	buf := make([]byte, udpBufSize)
+	ct := newConntrack(ConntrackConfig{Timeout: config.UDPTimeout})
+	defer ct.Close()
+
+	bpc := asBatchPacketConn(pc)
 
 	logf("listening UDP on %s", addr)
 	for {
-		n, addr, err := pc.ReadFrom(buf)
+		b := getPacketBatch()
+		n, err := bpc.ReadBatch(b.Messages, 0)
 		if err != nil {
+			putPacketBatch(b)
 			logf("UDP remote read error: %v", err)
 			continue
 		}
-		raddr, err := udpAddrToNetip(addr)
-		if err != nil {
-			logf("Address conversion failed: %v", err)
-			continue
-		}
-
-		tgtAddr := socks.SplitAddr(buf[:n])
-		if tgtAddr == nil {
-			logf("failed to split target address from packet: %q", buf[:n])
-			continue
-		}
 
-		tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
-		if err != nil {
-			logf("failed to resolve target UDP address: %v", err)
-			continue
-		}
+		for i := 0; i < n; i++ {
+			msg := &b.Messages[i]
+			raddr, err := udpAddrToNetip(msg.Addr)
+			if err != nil {
+				logf("Address conversion failed: %v", err)
+				continue
+			}
+			buf := msg.Buffers[0][:msg.N]
 
-		payload := buf[len(tgtAddr):n]
+			tgtAddr := socks.SplitAddr(buf)
+			if tgtAddr == nil {
+				logf("failed to split target address from packet: %q", buf)
+				continue
+			}
+			payload := buf[len(tgtAddr):]
 
-		pc := nm.Get(raddr)
-		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+			// Resolved before the policy check, rather than checking the
+			// raw SOCKS address, so a target domain name that resolves
+			// to a forbidden range (DNS rebinding) is rejected too, not
+			// just literal-IP targets.
+			tgtAddrPort, err := socksAddrToNetip(tgtAddr)
 			if err != nil {
-				logf("UDP remote listen error: %v", err)
+				logf("failed to resolve target UDP address: %v", err)
+				continue
+			}
+			if err := checkTargetPolicy(raddr, tgtAddrPort, len(payload)); err != nil {
+				logf("UDP remote policy reject: %v", err)
 				continue
 			}
 
-			nm.Add(raddr, pc, pc, remoteServer)
-		}
+			tc := ct.Get(raddr, tgtAddrPort)
+			if tc == nil {
+				tc, err = net.ListenPacket("udp", "")
+				if err != nil {
+					logf("UDP remote listen error: %v", err)
+					continue
+				}
 
-		_, err = pc.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
-		if err != nil {
-			logf("UDP remote write error: %v", err)
-			continue
+				ct.Add(raddr, tgtAddrPort, pc, tc, remoteServer, nil)
+			}
+
+			_, err = writeToUDPAddrPort(tc, payload, tgtAddrPort)
+			if err != nil {
+				logf("UDP remote write error: %v", err)
+				continue
+			}
 		}
+		putPacketBatch(b)
 	}
 }
 
-// Packet NAT table
-type natmap struct {
-	sync.RWMutex
-	m       map[netip.AddrPort]net.PacketConn
-	timeout time.Duration
-}
-
-func newNATmap(timeout time.Duration) *natmap {
-	m := &natmap{}
-	m.m = make(map[netip.AddrPort]net.PacketConn)
-	m.timeout = timeout
-	return m
-}
-
-func (m *natmap) Get(key netip.AddrPort) net.PacketConn {
-	m.RLock()
-	defer m.RUnlock()
-	return m.m[key]
-}
-
-func (m *natmap) Set(key netip.AddrPort, pc net.PacketConn) {
-	m.Lock()
-	defer m.Unlock()
-
-	m.m[key] = pc
-}
-
-func (m *natmap) Del(key netip.AddrPort) net.PacketConn {
-	m.Lock()
-	defer m.Unlock()
-
-	pc, ok := m.m[key]
-	if ok {
-		delete(m.m, key)
-		return pc
+// getOrDialServerConn returns the serverConn already tracked for
+// (client, target), or picks a server from eps, dials it, and tracks a
+// new flow for it. The server a flow picks is sticky for the flow's
+// lifetime; eps only sees a new Pick when a NAT entry is (re)created.
+// The server's health is reported back to eps once the flow closes.
+func getOrDialServerConn(ct *conntrack, eps *endpoints.Endpoints, dst net.PacketConn, client, target netip.AddrPort, role mode, shadow func(net.PacketConn) net.PacketConn) (*serverConn, error) {
+	if pc := ct.Get(client, target); pc != nil {
+		sc, ok := pc.(*serverConn)
+		if !ok {
+			return nil, fmt.Errorf("tracked conn for %s is not a serverConn", target)
+		}
+		return sc, nil
 	}
-	return nil
-}
 
-func (m *natmap) Add(peer netip.AddrPort, dst net.PacketConn, src net.PacketConn, role mode) {
-	m.Set(peer, src)
+	srv := eps.Pick(client)
+	srvAddr, err := net.ResolveUDPAddr("udp", srv)
+	if err != nil {
+		return nil, fmt.Errorf("resolve server %q: %w", srv, err)
+	}
 
-	go func() {
-		timedCopy(dst, peer, src, m.timeout, role)
-		if pc := m.Del(peer); pc != nil {
-			pc.Close()
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	sc := &serverConn{PacketConn: shadow(pc), server: srv, addr: srvAddr.AddrPort()}
+	logf("UDP tunnel %s <-> %s <-> %s", client, srv, target)
+	ct.Add(client, target, dst, sc, role, func(gotReply, timedOut bool) {
+		switch {
+		case gotReply:
+			// The server replied at least once, so hitting the idle
+			// timeout afterwards is an ordinary flow ending, not a
+			// server failure.
+			eps.ReportSuccess(srv)
+		case timedOut:
+			// Never got a single reply before the deadline: the server
+			// (or the path to it) is genuinely unresponsive.
+			eps.ReportTimeout(srv)
 		}
-	}()
+	})
+	return sc, nil
 }
 
-// copy from src to dst at target with read timeout
-func timedCopy(dst net.PacketConn, target netip.AddrPort, src net.PacketConn, timeout time.Duration, role mode) error {
-	buf := make([]byte, udpBufSize)
-
-	udpTarget := &net.UDPAddr{
-		IP:   target.Addr().AsSlice(),
-		Port: int(target.Port()),
-	}
-
+// copy from src to dst, addressing every relayed packet at client, with
+// a read timeout, reporting byte counts to metrics as it goes. Replies
+// pending on src are drained in one ReadBatch call when the platform
+// supports it (recvmmsg on Linux), since a burst of fragments from the
+// same flow is common, and relayed onto dst - which every message in a
+// flow shares - with a single matching WriteBatch call (sendmmsg) rather
+// than one write per message. The returned bool reports whether src ever
+// produced a datagram before the copy ended, which callers use to tell a
+// server that went quiet after replying apart from one that never
+// replied at all.
+func timedCopy(dst net.PacketConn, client netip.AddrPort, src net.PacketConn, timeout time.Duration, role mode, metrics Metrics) (bool, error) {
+	bpc := asBatchPacketConn(src)
+	bdst := asBatchPacketConn(dst)
+	b := getPacketBatch()
+	defer putPacketBatch(b)
+
+	dstAddr := net.UDPAddrFromAddrPort(client)
+	var outMsgs [udpBatchSize]ipv4.Message
+
+	gotReply := false
 	for {
 		src.SetReadDeadline(time.Now().Add(timeout))
-		n, addr, err := src.ReadFrom(buf)
+		n, err := bpc.ReadBatch(b.Messages, 0)
 		if err != nil {
-			return err
+			return gotReply, err
 		}
+		if n > 0 {
+			gotReply = true
+		}
+
+		out := 0
+		for i := 0; i < n; i++ {
+			msg := &b.Messages[i]
+			buf := msg.Buffers[0][:msg.N]
+			metrics.BytesIn(msg.N)
+
+			var framed []byte
+			switch role {
+			case remoteServer:
+				raddr, aerr := udpAddrToNetip(msg.Addr)
+				if aerr != nil {
+					continue
+				}
+				srcAddr := socks.ParseAddr(raddr.String())
+				full := msg.Buffers[0]
+				copy(full[len(srcAddr):], buf)
+				copy(full, srcAddr)
+				framed = full[:len(srcAddr)+msg.N]
+			case relayClient:
+				srcAddr := socks.SplitAddr(buf)
+				framed = buf[len(srcAddr):]
+			case socksClient:
+				framed = append([]byte{0, 0, 0}, buf...)
+			}
 
-		switch role {
-		case remoteServer:
-			srcAddr := socks.ParseAddr(addr.String())
-			copy(buf[len(srcAddr):], buf[:n])
-			copy(buf, srcAddr)
-			_, err = dst.WriteTo(buf[:len(srcAddr)+n], udpTarget)
-		case relayClient:
-			srcAddr := socks.SplitAddr(buf[:n])
-			_, err = dst.WriteTo(buf[len(srcAddr):n], udpTarget)
-		case socksClient:
-			_, err = dst.WriteTo(append([]byte{0, 0, 0}, buf[:n]...), udpTarget)
+			outMsgs[out].Buffers = [][]byte{framed}
+			outMsgs[out].Addr = dstAddr
+			out++
 		}
 
-		if err != nil {
-			return err
+		if out == 0 {
+			continue
+		}
+		if _, err := bdst.WriteBatch(outMsgs[:out], 0); err != nil {
+			return gotReply, err
 		}
+		for i := 0; i < out; i++ {
+			metrics.BytesOut(len(outMsgs[i].Buffers[0]))
+		}
+	}
+}
+
+// writeToUDPAddrPort writes a packet to addr via pc, using
+// WriteToUDPAddrPort directly when pc supports it and falling back to
+// WriteTo otherwise.
+func writeToUDPAddrPort(pc net.PacketConn, b []byte, addr netip.AddrPort) (int, error) {
+	if uc, ok := pc.(UDPConn); ok {
+		return uc.WriteToUDPAddrPort(b, addr)
 	}
+	return pc.WriteTo(b, net.UDPAddrFromAddrPort(addr))
 }
 
+// socksAddrToNetip parses a SOCKS address into a netip.AddrPort without a
+// DNS round trip when it already holds a literal IP, falling back to
+// net.ResolveUDPAddr for domain names.
+func socksAddrToNetip(addr socks.Addr) (netip.AddrPort, error) {
+	s := addr.String()
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap, nil
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return udpAddr.AddrPort(), nil
+}
+
+// udpAddrToNetip converts a *net.UDPAddr to a netip.AddrPort by copying
+// udp.IP's bytes directly, not through udp.IP.String() and
+// netip.ParseAddr - the batch read path (asBatchPacketConn) calls this
+// per message, and the string round trip is exactly the per-packet
+// allocation this package otherwise avoids.
 func udpAddrToNetip(addr net.Addr) (netip.AddrPort, error) {
 	udp, ok := addr.(*net.UDPAddr)
 	if !ok {
 		return netip.AddrPort{}, fmt.Errorf("not a UDPAddr")
 	}
-	ip, err := netip.ParseAddr(udp.IP.String())
-	if err != nil {
-		return netip.AddrPort{}, fmt.Errorf("invalid IP: %v", err)
-	}
-	if !ip.IsValid() {
+	ip, ok := netip.AddrFromSlice(udp.IP)
+	if !ok {
 		return netip.AddrPort{}, fmt.Errorf("invalid IP: %v", udp.IP)
 	}
+	if ip.Is4In6() {
+		ip = ip.Unmap()
+	}
 	return netip.AddrPortFrom(ip, uint16(udp.Port)), nil
 }
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/shadowsocks/go-shadowsocks2/endpoints"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// maxUoTFrame bounds a single UDP-over-TCP frame (SOCKS address plus
+// payload) to what fits the 2-byte length prefix.
+const maxUoTFrame = 0xffff
+
+// writeUoTFrame writes one length-prefixed UDP-over-TCP frame: a 2-byte
+// big-endian length, then a SOCKS address, then the payload.
+func writeUoTFrame(w io.Writer, addr socks.Addr, payload []byte) error {
+	n := len(addr) + len(payload)
+	if n > maxUoTFrame {
+		return fmt.Errorf("UDP-over-TCP frame too large: %d bytes", n)
+	}
+	var hdr [2]byte
+	binary.BigEndian.PutUint16(hdr[:], uint16(n))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(addr); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readUoTFrame reads one length-prefixed UDP-over-TCP frame from r into
+// buf, returning the SOCKS address and payload as views into buf.
+func readUoTFrame(r io.Reader, buf []byte) (socks.Addr, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > len(buf) {
+		return nil, nil, fmt.Errorf("UDP-over-TCP frame too large: %d bytes", n)
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, nil, err
+	}
+	addr := socks.SplitAddr(buf[:n])
+	if addr == nil {
+		return nil, nil, fmt.Errorf("invalid SOCKS address in UDP-over-TCP frame")
+	}
+	return addr, buf[len(addr):n], nil
+}
+
+// maxUoTTunnels caps how many local UDP clients' TCP tunnels are tracked
+// at once, evicting the least recently used to make room for a new one.
+// It mirrors conntrack's MaxEntries, since a tunnel is the UDP-over-TCP
+// equivalent of a conntrack flow.
+const maxUoTTunnels = 4096
+
+// uotTunnels maps a client's UDP address to the TCP conn tunneling its
+// datagrams, so packets from the same client reuse one TCP stream no
+// matter how many different targets they're addressed to. It bounds and
+// reports on tunnels the same way conntrack does for plain UDP flows
+// (LRU eviction, a size cap, the shared Metrics hook), but doesn't reuse
+// conntrack directly: a tunnel multiplexes every target over one TCP
+// net.Conn via framing, so there's no per-target net.PacketConn for
+// conntrack's timedCopy to relay.
+type uotTunnels struct {
+	mu      sync.Mutex
+	m       map[netip.AddrPort]*list.Element // value is *uotTunnel
+	lru     *list.List                       // front = least recently used
+	metrics Metrics
+}
+
+// uotTunnel is one tracked client's tunnel.
+type uotTunnel struct {
+	client netip.AddrPort
+	conn   net.Conn
+}
+
+func newUoTTunnels() *uotTunnels {
+	return &uotTunnels{
+		m:       make(map[netip.AddrPort]*list.Element),
+		lru:     list.New(),
+		metrics: udpMetrics,
+	}
+}
+
+func (t *uotTunnels) Get(client netip.AddrPort) net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elem, ok := t.m[client]
+	if !ok {
+		return nil
+	}
+	t.lru.MoveToBack(elem)
+	return elem.Value.(*uotTunnel).conn
+}
+
+func (t *uotTunnels) Set(client netip.AddrPort, conn net.Conn) {
+	t.mu.Lock()
+	var evicted *uotTunnel
+	if len(t.m) >= maxUoTTunnels {
+		if front := t.lru.Front(); front != nil {
+			evicted = front.Value.(*uotTunnel)
+			t.deleteLocked(front)
+		}
+	}
+	elem := t.lru.PushBack(&uotTunnel{client: client, conn: conn})
+	t.m[client] = elem
+	t.mu.Unlock()
+
+	if evicted != nil {
+		t.metrics.FlowEvicted()
+		evicted.conn.Close()
+	}
+	t.metrics.FlowOpened()
+}
+
+// Del removes client's tunnel, but only if it still points at conn (it
+// may already have been replaced or evicted), reporting whether this
+// call is the one that removed it. Callers use that to tell their own
+// natural end apart from being cut short by eviction.
+func (t *uotTunnels) Del(client netip.AddrPort, conn net.Conn) bool {
+	t.mu.Lock()
+	elem, ok := t.m[client]
+	if !ok || elem.Value.(*uotTunnel).conn != conn {
+		t.mu.Unlock()
+		return false
+	}
+	t.deleteLocked(elem)
+	t.mu.Unlock()
+	t.metrics.FlowClosed()
+	return true
+}
+
+// deleteLocked removes elem from the map and the LRU list. Callers must
+// hold t.mu.
+func (t *uotTunnels) deleteLocked(elem *list.Element) {
+	delete(t.m, elem.Value.(*uotTunnel).client)
+	t.lru.Remove(elem)
+}
+
+// udpOverTCPLocal listens on laddr for UDP datagrams addressed to
+// target and tunnels them to a server (picked per new tunnel from
+// servers via strategy) over a TCP connection, framing each datagram as
+// a 2-byte length, a SOCKS address, and the payload. This lets the
+// client reach target on networks that block or heavily throttle plain
+// UDP; no command-line flag selects this mode. One TCP connection is
+// opened per client and reused for every packet it sends; a
+// demultiplexer goroutine reads framed replies off it and writes them
+// back to the client via c.WriteTo.
+func udpOverTCPLocal(laddr string, servers []string, strategy endpoints.Strategy, target string, shadow func(net.Conn) net.Conn) {
+	if len(servers) == 0 {
+		logf("UDP server address error: no servers configured")
+		return
+	}
+	eps := endpoints.New(servers, strategy)
+
+	tgt := socks.ParseAddr(target)
+	if tgt == nil {
+		logf("UDP target address error: invalid target address: %q", target)
+		return
+	}
+
+	lnAddr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		logf("UDP listen address error: %v", err)
+		return
+	}
+	c, err := net.ListenUDP("udp", lnAddr)
+	if err != nil {
+		logf("UDP local listen error: %v", err)
+		return
+	}
+	defer c.Close()
+
+	tunnels := newUoTTunnels()
+	buf := make([]byte, udpBufSize)
+
+	logf("UDP-over-TCP tunnel %s <-> %v <-> %s", laddr, servers, target)
+	for {
+		n, raddr, err := c.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			logf("UDP local read error: %v", err)
+			continue
+		}
+
+		conn := tunnels.Get(raddr)
+		if conn == nil {
+			srv := eps.Pick(raddr)
+			rc, err := net.Dial("tcp", srv)
+			if err != nil {
+				logf("UDP-over-TCP dial error: %v", err)
+				eps.ReportTimeout(srv)
+				continue
+			}
+			conn = shadow(rc)
+			tunnels.Set(raddr, conn)
+			go demuxUoTReplies(c, raddr, conn, tunnels, eps, srv)
+		}
+
+		if err := writeUoTFrame(conn, tgt, buf[:n]); err != nil {
+			logf("UDP-over-TCP write error: %v", err)
+			conn.Close()
+			tunnels.Del(raddr, conn)
+		}
+	}
+}
+
+// demuxUoTReplies reads framed datagrams off conn, the tunnel for
+// client dialed to srv, until it errors or the peer closes it, writing
+// each payload back to client via c.WriteTo. Once the tunnel ends on its
+// own (not cut short by eviction), srv's health is reported to eps:
+// success if the tunnel ever relayed a reply, failure if it never did.
+func demuxUoTReplies(c *net.UDPConn, client netip.AddrPort, conn net.Conn, tunnels *uotTunnels, eps *endpoints.Endpoints, srv string) {
+	gotReply := false
+	defer func() {
+		natural := tunnels.Del(client, conn)
+		conn.Close()
+		if natural {
+			if gotReply {
+				eps.ReportSuccess(srv)
+			} else {
+				eps.ReportTimeout(srv)
+			}
+		}
+	}()
+
+	buf := make([]byte, udpBufSize)
+	clientAddr := net.UDPAddrFromAddrPort(client)
+	for {
+		_, payload, err := readUoTFrame(conn, buf)
+		if err != nil {
+			return
+		}
+		gotReply = true
+		if _, err := c.WriteTo(payload, clientAddr); err != nil {
+			return
+		}
+	}
+}
+
+// udpOverTCPRemote serves one UDP-over-TCP client connection, conn;
+// tcpRemote does not hand connections to it, and no listener calls it.
+// Every framed
+// datagram read from conn is checked against targetPolicy (the same gate
+// udpRemote applies) and, if allowed, relayed to its target over a
+// shared UDP socket; every reply that arrives on that socket is framed
+// back onto conn.
+func udpOverTCPRemote(conn net.Conn) {
+	defer conn.Close()
+
+	var client netip.AddrPort
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		client = tcpAddr.AddrPort()
+	}
+
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		logf("UDP-over-TCP remote listen error: %v", err)
+		return
+	}
+	defer pc.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, udpBufSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			raddr, err := udpAddrToNetip(addr)
+			if err != nil {
+				continue
+			}
+			srcAddr := socks.ParseAddr(raddr.String())
+			if err := writeUoTFrame(conn, srcAddr, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, udpBufSize)
+	for {
+		tgtAddr, payload, err := readUoTFrame(conn, buf)
+		if err != nil {
+			break
+		}
+		tgtAddrPort, err := socksAddrToNetip(tgtAddr)
+		if err != nil {
+			logf("failed to resolve target UDP address: %v", err)
+			continue
+		}
+		if err := checkTargetPolicy(client, tgtAddrPort, len(payload)); err != nil {
+			logf("UDP-over-TCP remote policy reject: %v", err)
+			continue
+		}
+		if _, err := writeToUDPAddrPort(pc, payload, tgtAddrPort); err != nil {
+			logf("UDP-over-TCP remote write error: %v", err)
+			break
+		}
+	}
+	pc.Close()
+	<-done
+}